@@ -2,13 +2,17 @@ package db
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
@@ -25,6 +29,9 @@ var (
 	ErrSavingToFile = errors.New("failed to write to file")
 	// ErrClosedDB happens when operations are done after the DB was closed.
 	ErrClosedDB = errors.New("DB is closed")
+	// ErrDuplicateValue indicates an error when using a value
+	// another key holds, see WithUniqueValues.
+	ErrDuplicateValue = errors.New("value already exists")
 )
 
 var (
@@ -34,6 +41,12 @@ var (
 
 const (
 	keyValueSep = ":"
+	// defaultWriteRetries is the number of times a write is retried
+	// on a transient error before giving up.
+	defaultWriteRetries = 3
+	// retryBackoff is the wait before the first retry, each
+	// next retry waits one more backoff.
+	retryBackoff = 5 * time.Millisecond
 )
 
 // DB is a database with the basic CRUD operations.
@@ -44,38 +57,192 @@ type DB interface {
 	Delete(key string) (string, error)
 }
 
+// file is the subset of *os.File used by FileDB.
+type file interface {
+	io.Writer
+	io.Closer
+	Truncate(size int64) error
+	Seek(offset int64, whence int) (int64, error)
+}
+
 // FileDB is a DB holding data in-memory and making
 // persistence to a file.
 type FileDB struct {
 	mu   sync.Mutex
 	data map[string]string
-	file *os.File
+	file file
+
+	// writeRetries is the number of times a write is retried
+	// on a transient error.
+	writeRetries int
+
+	// remote is the store the file is a cache of, if any.
+	remote      Store
+	version     string
+	versionFile string
+	// stale is set when the remote store changed under the cache.
+	stale bool
+
+	// index maps values to their key when unique is set.
+	unique bool
+	index  map[string]string
+
+	// sem limits the operations running at once, if set.
+	sem      chan struct{}
+	inFlight int64
+
+	// pending holds the keys, and values with unique values, of
+	// the writes waiting on the remote store, see reserve.
+	pending map[string]chan struct{}
+	writes  sync.WaitGroup
 
 	cmu    sync.RWMutex
 	closed bool
 }
 
+// Stats holds runtime statistics of a FileDB.
+type Stats struct {
+	// InFlight is the number of operations holding a slot, see
+	// WithMaxConcurrency. It includes the ones waiting for a
+	// write on the same key to finish.
+	InFlight int
+}
+
+// Option configures a FileDB.
+type Option func(*FileDB)
+
+// WithWriteRetries sets how many times a write to the file
+// is retried on a transient error (EINTR, EAGAIN) before
+// failing with ErrSavingToFile.
+func WithWriteRetries(n int) Option {
+	return func(db *FileDB) {
+		db.writeRetries = n
+	}
+}
+
+// WithMaxConcurrency limits the operations running at once to n,
+// the rest wait for a free slot. Zero means unlimited.
+//
+// Calls to the remote store run outside the DB lock, so up to n of
+// them reach the store at once. Writes on the same key, or the same
+// value with WithUniqueValues, still run one after the other. The
+// context of the *Context methods is honoured while waiting for a
+// slot or for such a write.
+func WithMaxConcurrency(n int) Option {
+	return func(db *FileDB) {
+		if n > 0 {
+			db.sem = make(chan struct{}, n)
+		}
+	}
+}
+
+// WithUniqueValues makes Create and Update reject a value
+// another key holds with ErrDuplicateValue.
+// It is not supported by ShardedDB.
+func WithUniqueValues() Option {
+	return func(db *FileDB) {
+		db.unique = true
+	}
+}
+
+// LoadReport describes how the data of a FileDB was loaded.
+type LoadReport struct {
+	// WasCreated is true if the file didn't exist when opened,
+	// i.e. this is the first run. With WithRemote it is true
+	// if the remote store was never written.
+	WasCreated bool
+}
+
 // NewFileDB returns a DB with the data of the
 // file loaded.
-func NewFileDB(filename string) (*FileDB, error) {
+func NewFileDB(filename string, opts ...Option) (*FileDB, error) {
+	db, _, err := OpenWithReport(filename, opts...)
+	return db, err
+}
+
+// OpenWithReport is like NewFileDB but also reports how
+// the data was loaded.
+func OpenWithReport(filename string, opts ...Option) (*FileDB, LoadReport, error) {
+	var report LoadReport
+	if _, err := os.Stat(filename); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, report, ErrOpeningFile
+		}
+		report.WasCreated = true
+	}
 	// If the file doesn't exist, create it, or append to the file
 	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		return nil, ErrOpeningFile
+		return nil, report, ErrOpeningFile
 	}
 	b, err := ioutil.ReadAll(f)
 	if err != nil {
-		fmt.Println(err)
-		return nil, ErrOpeningFile
+		f.Close()
+		return nil, report, ErrOpeningFile
+	}
+	db := &FileDB{
+		file:         f,
+		writeRetries: defaultWriteRetries,
+	}
+	for _, opt := range opts {
+		opt(db)
 	}
 	data, err := parseData(string(b))
-	if err != nil {
-		return nil, err
+	// With a remote store a corrupt cache is just stale.
+	if err != nil && db.remote == nil {
+		f.Close()
+		return nil, report, err
+	}
+	db.data = data
+	if db.remote != nil {
+		if err := db.sync(filename, err != nil || report.WasCreated); err != nil {
+			f.Close()
+			return nil, report, err
+		}
+		report.WasCreated = db.version == ""
+	}
+	if db.unique {
+		if err := db.buildIndex(); err != nil {
+			f.Close()
+			return nil, report, err
+		}
+	}
+	return db, report, nil
+}
+
+// buildIndex builds the value to key index from the data.
+func (db *FileDB) buildIndex() error {
+	db.index = make(map[string]string, len(db.data))
+	for k, v := range db.data {
+		if _, ok := db.index[v]; ok {
+			return ErrDuplicateValue
+		}
+		db.index[v] = k
+	}
+	return nil
+}
+
+// checkValue returns ErrDuplicateValue if val is held
+// by a key other than `key`.
+func (db *FileDB) checkValue(key, val string) error {
+	if !db.unique {
+		return nil
+	}
+	if k, ok := db.index[val]; ok && k != key {
+		return ErrDuplicateValue
+	}
+	return nil
+}
+
+// set sets key to val keeping the index up to date.
+func (db *FileDB) set(key, val string) {
+	if db.unique {
+		if old, ok := db.data[key]; ok {
+			delete(db.index, old)
+		}
+		db.index[val] = key
 	}
-	return &FileDB{
-		data: data,
-		file: f,
-	}, nil
+	db.data[key] = val
 }
 
 func parseData(data string) (map[string]string, error) {
@@ -93,23 +260,118 @@ func parseData(data string) (map[string]string, error) {
 }
 
 // Close dumps all the data into the file.
+// Operations already running finish before the data is dumped,
+// the ones waiting fail with ErrClosedDB.
 func (db *FileDB) Close() error {
-	if err := db.isClosed(); err != nil {
-		return err
-	}
+	// closed is set under db.mu so writes checking it under
+	// db.mu are either waited for or fail.
+	db.mu.Lock()
 	db.cmu.Lock()
+	if db.closed {
+		db.cmu.Unlock()
+		db.mu.Unlock()
+		return ErrClosedDB
+	}
 	db.closed = true
 	db.cmu.Unlock()
-	db.file.Truncate(0)
-	db.file.Seek(0, 0)
+	db.mu.Unlock()
+	if err := db.acquire(context.Background()); err != nil {
+		return err
+	}
+	defer db.release()
+	db.writes.Wait()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.flush(); err != nil {
+		db.file.Close()
+		return err
+	}
+	if err := db.file.Close(); err != nil {
+		return err
+	}
+	return db.saveVersion()
+}
+
+// flush replaces the content of the file with the data.
+func (db *FileDB) flush() error {
+	if err := db.retry(func() error { return db.file.Truncate(0) }); err != nil {
+		return err
+	}
+	if err := db.retry(func() error {
+		_, err := db.file.Seek(0, 0)
+		return err
+	}); err != nil {
+		return err
+	}
 	for k, v := range db.data {
 		b := append([]byte(k), []byte(":")...)
 		b = append(b, []byte(v)...)
-		if _, err := db.file.Write(append(b, []byte("\n")...)); err != nil {
+		if err := db.write(append(b, []byte("\n")...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes b to the file, retrying on transient errors.
+func (db *FileDB) write(b []byte) error {
+	return db.retry(func() error {
+		n, err := db.file.Write(b)
+		b = b[n:]
+		return err
+	})
+}
+
+// retry calls fn until it succeeds, fails with a non transient
+// error or db.writeRetries retries are done, backing off between
+// attempts.
+func (db *FileDB) retry(fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if !isRetryable(err) || attempt >= db.writeRetries {
 			return ErrSavingToFile
 		}
+		time.Sleep(time.Duration(attempt+1) * retryBackoff)
 	}
-	return db.file.Close()
+}
+
+// isRetryable reports whether a write error is transient.
+func isRetryable(err error) bool {
+	return errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN)
+}
+
+// acquire waits for a free slot to run an operation or
+// until ctx is done. Each successful call must be followed
+// by a call to release.
+func (db *FileDB) acquire(ctx context.Context) error {
+	// select picks at random when a slot is free too.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if db.sem != nil {
+		select {
+		case db.sem <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.AddInt64(&db.inFlight, 1)
+	return nil
+}
+
+func (db *FileDB) release() {
+	atomic.AddInt64(&db.inFlight, -1)
+	if db.sem != nil {
+		<-db.sem
+	}
+}
+
+// Stats returns runtime statistics of the DB.
+func (db *FileDB) Stats() Stats {
+	return Stats{InFlight: int(atomic.LoadInt64(&db.inFlight))}
 }
 
 func (db *FileDB) isClosed() error {
@@ -121,34 +383,134 @@ func (db *FileDB) isClosed() error {
 	return nil
 }
 
+// reserve waits until no other write runs on key, or on vals with
+// unique values, and reserves them for the caller, who must call
+// unreserve afterwards. It must be called with db.mu held, which is
+// released while waiting. It fails if ctx is done or the DB gets
+// closed meanwhile.
+func (db *FileDB) reserve(ctx context.Context, key string, vals ...string) error {
+	names := db.pendingNames(key, vals)
+	for {
+		if err := db.isClosed(); err != nil {
+			return err
+		}
+		var busy chan struct{}
+		for _, n := range names {
+			if ch, ok := db.pending[n]; ok {
+				busy = ch
+				break
+			}
+		}
+		if busy == nil {
+			break
+		}
+		db.mu.Unlock()
+		select {
+		case <-busy:
+		case <-ctx.Done():
+			db.mu.Lock()
+			return ctx.Err()
+		}
+		db.mu.Lock()
+	}
+	if db.pending == nil {
+		db.pending = make(map[string]chan struct{})
+	}
+	ch := make(chan struct{})
+	for _, n := range names {
+		db.pending[n] = ch
+	}
+	db.writes.Add(1)
+	return nil
+}
+
+// unreserve releases what reserve reserved, waking up the
+// writes waiting on it. It must be called with db.mu held.
+func (db *FileDB) unreserve(key string, vals ...string) {
+	names := db.pendingNames(key, vals)
+	close(db.pending[names[0]])
+	for _, n := range names {
+		delete(db.pending, n)
+	}
+	db.writes.Done()
+}
+
+// pendingNames returns the names key and vals are reserved with.
+func (db *FileDB) pendingNames(key string, vals []string) []string {
+	names := []string{"k" + key}
+	if db.unique {
+		for _, v := range vals {
+			names = append(names, "v"+v)
+		}
+	}
+	return names
+}
+
 // Create implements the create method of DB.
 // If the key already exists it returns ErrDuplicatedKey.
+// If unique values are enforced and another key holds the
+// value it returns ErrDuplicateValue.
 // If the  value doesn't follow the basic format it returns
 // ErrWrongFormat.
 func (db *FileDB) Create(key, val string) error {
+	return db.CreateContext(context.Background(), key, val)
+}
+
+// CreateContext is like Create but gives up waiting for a free
+// slot, or for a write on the same key, when ctx is done,
+// see WithMaxConcurrency.
+func (db *FileDB) CreateContext(ctx context.Context, key, val string) error {
 	if err := db.isClosed(); err != nil {
 		return err
 	}
 	if !keyFormat.MatchString(key) {
 		return ErrWrongFormat
 	}
+	if err := db.acquire(ctx); err != nil {
+		return err
+	}
+	defer db.release()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.reserve(ctx, key, val); err != nil {
+		return err
+	}
+	defer db.unreserve(key, val)
 	if _, ok := db.data[key]; ok {
 		return ErrDuplicatedKey
 	}
-	db.data[key] = val
+	if err := db.checkValue(key, val); err != nil {
+		return err
+	}
+	if err := db.put(key, val); err != nil {
+		return err
+	}
+	db.set(key, val)
 	return nil
 }
 
 // Read retrieves the value from the database, if it not exists
 // it returns ErrKeyNotFound.
 func (db *FileDB) Read(key string) (string, error) {
+	return db.ReadContext(context.Background(), key)
+}
+
+// ReadContext is like Read but gives up waiting for a free
+// slot when ctx is done, see WithMaxConcurrency.
+func (db *FileDB) ReadContext(ctx context.Context, key string) (string, error) {
 	if err := db.isClosed(); err != nil {
 		return "", err
 	}
+	if err := db.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer db.release()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	// Close may have run while waiting.
+	if err := db.isClosed(); err != nil {
+		return "", err
+	}
 	v, ok := db.data[key]
 	if !ok {
 		return "", ErrKeyNotFound
@@ -158,33 +520,125 @@ func (db *FileDB) Read(key string) (string, error) {
 
 // Update updates the `key` with `value`.
 // If the key already exists it returns ErrDuplicatedKey.
+// If unique values are enforced and another key holds the
+// value it returns ErrDuplicateValue.
 // If the  value doesn't follow the basic format it returns
 // ErrWrongFormat.
 func (db *FileDB) Update(key, val string) error {
+	return db.UpdateContext(context.Background(), key, val)
+}
+
+// UpdateContext is like Update but gives up waiting for a free
+// slot, or for a write on the same key, when ctx is done,
+// see WithMaxConcurrency.
+func (db *FileDB) UpdateContext(ctx context.Context, key, val string) error {
 	if err := db.isClosed(); err != nil {
 		return err
 	}
+	if err := db.acquire(ctx); err != nil {
+		return err
+	}
+	defer db.release()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.reserve(ctx, key, val); err != nil {
+		return err
+	}
+	defer db.unreserve(key, val)
 	if _, ok := db.data[key]; !ok {
 		return ErrKeyNotFound
 	}
-	db.data[key] = val
+	if err := db.checkValue(key, val); err != nil {
+		return err
+	}
+	if err := db.put(key, val); err != nil {
+		return err
+	}
+	db.set(key, val)
 	return nil
 }
 
 // Delete retrieves the value from the database and deletes it.
 // If it not exists it returns ErrKeyNotFound.
 func (db *FileDB) Delete(key string) (string, error) {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete but gives up waiting for a free
+// slot, or for a write on the same key, when ctx is done,
+// see WithMaxConcurrency.
+func (db *FileDB) DeleteContext(ctx context.Context, key string) (string, error) {
 	if err := db.isClosed(); err != nil {
 		return "", err
 	}
+	if err := db.acquire(ctx); err != nil {
+		return "", err
+	}
+	defer db.release()
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if err := db.reserve(ctx, key); err != nil {
+		return "", err
+	}
+	defer db.unreserve(key)
 	v, ok := db.data[key]
 	if !ok {
 		return "", ErrKeyNotFound
 	}
+	if err := db.remove(key); err != nil {
+		return "", err
+	}
+	if db.unique {
+		delete(db.index, v)
+	}
 	delete(db.data, key)
 	return v, nil
 }
+
+// Keys returns all the keys in the database, in no particular order.
+func (db *FileDB) Keys() ([]string, error) {
+	if err := db.isClosed(); err != nil {
+		return nil, err
+	}
+	if err := db.acquire(context.Background()); err != nil {
+		return nil, err
+	}
+	defer db.release()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Close may have run while waiting.
+	if err := db.isClosed(); err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(db.data))
+	for k := range db.data {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// ForEach calls fn for every key-value pair in the database,
+// in no particular order. If fn returns an error the iteration
+// stops and the error is returned.
+// fn must not call other methods of the DB.
+func (db *FileDB) ForEach(fn func(key, val string) error) error {
+	if err := db.isClosed(); err != nil {
+		return err
+	}
+	if err := db.acquire(context.Background()); err != nil {
+		return err
+	}
+	defer db.release()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Close may have run while waiting.
+	if err := db.isClosed(); err != nil {
+		return err
+	}
+	for k, v := range db.data {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
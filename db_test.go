@@ -1,10 +1,49 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
+// flakyFile is a file that fails the first `fails` writes and
+// `truncFails` truncates with `err`.
+type flakyFile struct {
+	bytes.Buffer
+	fails      int
+	truncFails int
+	err        error
+	closed     bool
+}
+
+func (f *flakyFile) Write(b []byte) (int, error) {
+	if f.fails > 0 {
+		f.fails--
+		return 0, f.err
+	}
+	return f.Buffer.Write(b)
+}
+
+func (f *flakyFile) Truncate(int64) error {
+	if f.truncFails > 0 {
+		f.truncFails--
+		return f.err
+	}
+	f.Buffer.Reset()
+	return nil
+}
+
+func (f *flakyFile) Close() error                   { f.closed = true; return nil }
+func (f *flakyFile) Seek(int64, int) (int64, error) { return 0, nil }
+
 func TestNewFileDBErrors(t *testing.T) {
 	if _, err := NewFileDB("/var/nopermtestHASH"); err == nil {
 		t.Fatalf("expected error when opening file we don't own")
@@ -39,6 +78,125 @@ func TestFilePersistence(t *testing.T) {
 	}
 }
 
+func TestCloseWriteRetries(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		retries    int
+		fails      int
+		truncFails int
+		err        error
+		wantErr    bool
+	}{
+		{name: "transient error recovers", retries: 3, fails: 2, err: syscall.EINTR, wantErr: false},
+		{name: "transient error exhausts retries", retries: 1, fails: 2, err: syscall.EAGAIN, wantErr: true},
+		{name: "non retryable error", retries: 3, fails: 1, err: syscall.ENOSPC, wantErr: true},
+		{name: "transient truncate error recovers", retries: 3, truncFails: 2, err: syscall.EINTR, wantErr: false},
+		{name: "non retryable truncate error", retries: 3, truncFails: 1, err: syscall.EROFS, wantErr: true},
+	}
+	for _, c := range cases {
+		f := &flakyFile{fails: c.fails, truncFails: c.truncFails, err: c.err}
+		f.WriteString("old:data\n")
+		db := &FileDB{
+			file:         f,
+			data:         map[string]string{"key": "value"},
+			writeRetries: c.retries,
+		}
+		t.Run(c.name, func(t *testing.T) {
+			err := db.Close()
+			if (err != nil) != c.wantErr {
+				t.Fatalf("db.Close() error = %v, wantErr %v", err, c.wantErr)
+			}
+			if c.wantErr && err != ErrSavingToFile {
+				t.Errorf("db.Close() error = %v, want %v", err, ErrSavingToFile)
+			}
+			if !c.wantErr && f.String() != "key:value\n" {
+				t.Errorf("file content = %q, want %q", f.String(), "key:value\n")
+			}
+			if !f.closed {
+				t.Errorf("expected db.Close() to close the file")
+			}
+		})
+	}
+}
+
+func TestOpenWithReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "report.data")
+
+	db, report, err := OpenWithReport(filename)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if !report.WasCreated {
+		t.Errorf("expected WasCreated on first open")
+	}
+	if err := db.Create("key", "value"); err != nil {
+		t.Fatalf("db.Create() error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	db, report, err = OpenWithReport(filename)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if report.WasCreated {
+		t.Errorf("expected no WasCreated when opening existing data")
+	}
+	if _, err := db.Delete("key"); err != nil {
+		t.Fatalf("db.Delete() error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	db, report, err = OpenWithReport(filename)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	defer db.Close()
+	if report.WasCreated {
+		t.Errorf("expected no WasCreated when opening an existing empty DB")
+	}
+}
+
+func TestOpenWithReportRemote(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name           string
+		store          *memStore
+		wantWasCreated bool
+	}{
+		{name: "new store", store: &memStore{data: map[string]string{}}, wantWasCreated: true},
+		{name: "existing store", store: newMemStore(map[string]string{"key": "value"}), wantWasCreated: false},
+	}
+	for i, c := range cases {
+		filename := filepath.Join(dir, strconv.Itoa(i)+".data")
+		t.Run(c.name, func(t *testing.T) {
+			db, report, err := OpenWithReport(filename, WithRemote(c.store))
+			if err != nil {
+				t.Fatalf("failed to open DB: %s", err)
+			}
+			defer db.Close()
+			if report.WasCreated != c.wantWasCreated {
+				t.Errorf("WasCreated = %v, want %v", report.WasCreated, c.wantWasCreated)
+			}
+		})
+	}
+}
+
 func TestClosedDB(t *testing.T) {
 	db, err := NewFileDB("testdata/testdata.data")
 	if err != nil {
@@ -182,6 +340,220 @@ func TestDelete(t *testing.T) {
 	}
 }
 
+func TestUniqueValues(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		op      func(db *FileDB) error
+		wantErr error
+	}{
+		{name: "create with new value", op: func(db *FileDB) error { return db.Create("c", "3") }},
+		{name: "create with held value", op: func(db *FileDB) error { return db.Create("c", "1") }, wantErr: ErrDuplicateValue},
+		{name: "update with own value", op: func(db *FileDB) error { return db.Update("a", "1") }},
+		{name: "update with held value", op: func(db *FileDB) error { return db.Update("a", "2") }, wantErr: ErrDuplicateValue},
+		{name: "update releases old value", op: func(db *FileDB) error {
+			if err := db.Update("a", "3"); err != nil {
+				return err
+			}
+			return db.Create("c", "1")
+		}},
+		{name: "delete releases value", op: func(db *FileDB) error {
+			if _, err := db.Delete("a"); err != nil {
+				return err
+			}
+			return db.Create("c", "1")
+		}},
+	}
+	for _, c := range cases {
+		db := &FileDB{
+			data:   map[string]string{"a": "1", "b": "2"},
+			unique: true,
+		}
+		if err := db.buildIndex(); err != nil {
+			t.Fatalf("db.buildIndex() error = %v", err)
+		}
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.op(db); err != c.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+
+	db := &FileDB{data: map[string]string{"a": "1", "b": "1"}, unique: true}
+	if err := db.buildIndex(); err != ErrDuplicateValue {
+		t.Errorf("db.buildIndex() error = %v, wantErr %v", err, ErrDuplicateValue)
+	}
+}
+
+// slowStore is a Store whose writes block until release is closed.
+// It tracks how many writes run at once.
+type slowStore struct {
+	*memStore
+	release   chan struct{}
+	active    int64
+	maxActive int64
+}
+
+func (s *slowStore) Put(key, value string) (string, error) {
+	n := atomic.AddInt64(&s.active, 1)
+	for {
+		max := atomic.LoadInt64(&s.maxActive)
+		if n <= max || atomic.CompareAndSwapInt64(&s.maxActive, max, n) {
+			break
+		}
+	}
+	defer atomic.AddInt64(&s.active, -1)
+	<-s.release
+	return s.memStore.Put(key, value)
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	s := &slowStore{memStore: newMemStore(map[string]string{}), release: make(chan struct{})}
+	db := &FileDB{data: map[string]string{}, remote: s}
+	WithMaxConcurrency(2)(db)
+
+	var max int64
+	done, sampled := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if n := int64(db.Stats().InFlight); n > max {
+				max = n
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Create("key"+strconv.Itoa(i), "value"); err != nil {
+				t.Errorf("db.Create() error = %v", err)
+			}
+		}(i)
+	}
+	// Both slots must reach the store at once.
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&s.active) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.CreateContext(ctx, "other", "value"); err != context.DeadlineExceeded {
+		t.Errorf("db.CreateContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(s.release)
+	wg.Wait()
+	close(done)
+	<-sampled
+	if max != 2 {
+		t.Errorf("max in-flight operations = %d, want 2", max)
+	}
+	if s.maxActive != 2 {
+		t.Errorf("max concurrent store writes = %d, want 2", s.maxActive)
+	}
+	if n := db.Stats().InFlight; n != 0 {
+		t.Errorf("in-flight operations after load = %d, want 0", n)
+	}
+	if keys, _ := db.Keys(); len(keys) != 6 {
+		t.Errorf("db.Keys() = %d keys, want 6", len(keys))
+	}
+
+	// A cancelled context fails even when a slot is free.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	for i := 0; i < 100; i++ {
+		if _, err := db.ReadContext(ctx, "key0"); err != context.Canceled {
+			t.Fatalf("db.ReadContext() error = %v, want %v", err, context.Canceled)
+		}
+	}
+}
+
+func TestWriteWaitsOnSameKey(t *testing.T) {
+	s := &slowStore{memStore: newMemStore(map[string]string{}), release: make(chan struct{})}
+	db := &FileDB{data: map[string]string{}, remote: s}
+
+	created := make(chan error)
+	go func() { created <- db.Create("a", "value") }()
+	for atomic.LoadInt64(&s.active) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The store call doesn't hold the DB lock.
+	if _, err := db.Read("a"); err != ErrKeyNotFound {
+		t.Errorf("db.Read() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := db.UpdateContext(ctx, "a", "other"); err != context.DeadlineExceeded {
+		t.Errorf("db.UpdateContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(s.release)
+	if err := <-created; err != nil {
+		t.Fatalf("db.Create() error = %v", err)
+	}
+	if err := db.Update("a", "other"); err != nil {
+		t.Errorf("db.Update() error = %v", err)
+	}
+	if v, _ := db.Read("a"); v != "other" {
+		t.Errorf("db.Read() = %q, want %q", v, "other")
+	}
+}
+
+func TestCloseWaitsForOperations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "close.data")
+	s := &slowStore{memStore: newMemStore(map[string]string{}), release: make(chan struct{})}
+	db, err := NewFileDB(filename, WithRemote(s), WithMaxConcurrency(1))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+
+	running, queued, closed := make(chan error), make(chan error), make(chan error)
+	go func() { running <- db.Create("a", "value") }()
+	for db.Stats().InFlight < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	go func() { queued <- db.Create("b", "value") }()
+	time.Sleep(10 * time.Millisecond)
+	go func() { closed <- db.Close() }()
+	for db.isClosed() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	close(s.release)
+	if err := <-running; err != nil {
+		t.Errorf("running db.Create() error = %v", err)
+	}
+	if err := <-queued; err != ErrClosedDB {
+		t.Errorf("queued db.Create() error = %v, want %v", err, ErrClosedDB)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("err reading file: %s", err)
+	}
+	if string(b) != "a:value\n" {
+		t.Errorf("file content = %q, want %q", b, "a:value\n")
+	}
+}
+
 func TestParseData(t *testing.T) {
 	t.Parallel()
 
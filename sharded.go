@@ -0,0 +1,253 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrShardCount happens when the shard count is invalid or doesn't
+	// match the one the directory was created with.
+	ErrShardCount = errors.New("invalid shard count")
+	// ErrShardHash happens when the hash doesn't match the one the
+	// directory was created with.
+	ErrShardHash = errors.New("hash doesn't match the saved one")
+	// ErrShardOption happens when an Option can't be used in a shard.
+	ErrShardOption = errors.New("option not supported by ShardedDB")
+)
+
+const (
+	shardConfigFile = "shards"
+	defaultHashName = "fnv32a"
+)
+
+var _ DB = (*ShardedDB)(nil)
+
+// HashFunc maps a key to a shard. It must return the same value
+// for the same key between runs.
+type HashFunc func(key string) uint32
+
+// ShardedDB is a DB spreading its keys over several FileDB,
+// each one with its own file and lock.
+type ShardedDB struct {
+	shards []*FileDB
+	hash   HashFunc
+}
+
+type shardConfig struct {
+	hash     HashFunc
+	hashName string
+	opts     []Option
+}
+
+// ShardOption configures a ShardedDB.
+type ShardOption func(*shardConfig)
+
+// WithHash sets the function used to route keys to shards.
+// The default is FNV-1a. name identifies h and is saved in the
+// directory, opening it again with another name returns
+// ErrShardHash. Change the name whenever h changes.
+func WithHash(name string, h HashFunc) ShardOption {
+	return func(c *shardConfig) {
+		c.hashName = name
+		c.hash = h
+	}
+}
+
+// WithShardOptions sets the options every shard is opened with.
+// WithRemote and WithUniqueValues are not supported and
+// return ErrShardOption.
+// WithMaxConcurrency limits each shard on its own, not the
+// whole ShardedDB.
+func WithShardOptions(opts ...Option) ShardOption {
+	return func(c *shardConfig) {
+		c.opts = append(c.opts, opts...)
+	}
+}
+
+// NewShardedDB returns a DB with its data split in `shards` files
+// inside dir. The shard count and hash name are saved in dir the
+// first time, and opening dir again with a different count returns
+// ErrShardCount, with a different hash ErrShardHash.
+func NewShardedDB(dir string, shards int, opts ...ShardOption) (*ShardedDB, error) {
+	if shards < 1 {
+		return nil, ErrShardCount
+	}
+	c := shardConfig{hash: fnvHash, hashName: defaultHashName}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.hash == nil || c.hashName == "" || strings.ContainsAny(c.hashName, "\n") {
+		return nil, ErrWrongFormat
+	}
+	if err := checkShardOptions(c.opts); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, ErrOpeningFile
+	}
+	if err := checkShardConfig(filepath.Join(dir, shardConfigFile), shards, c.hashName); err != nil {
+		return nil, err
+	}
+	db := &ShardedDB{hash: c.hash}
+	for i := 0; i < shards; i++ {
+		s, err := NewFileDB(filepath.Join(dir, fmt.Sprintf("shard-%03d.data", i)), c.opts...)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.shards = append(db.shards, s)
+	}
+	return db, nil
+}
+
+// checkShardOptions returns ErrShardOption if the options
+// can't be used in a shard.
+func checkShardOptions(opts []Option) error {
+	probe := &FileDB{}
+	for _, opt := range opts {
+		opt(probe)
+	}
+	// Every shard would cache the whole remote store.
+	if probe.remote != nil {
+		return ErrShardOption
+	}
+	// Values would only be unique within a shard.
+	if probe.unique {
+		return ErrShardOption
+	}
+	return nil
+}
+
+// checkShardConfig saves the shard count and hash name in filename,
+// or verifies they match if they were already saved.
+func checkShardConfig(filename string, shards int, hashName string) error {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		conf := strconv.Itoa(shards) + "\n" + hashName + "\n"
+		if err := ioutil.WriteFile(filename, []byte(conf), 0644); err != nil {
+			return ErrSavingToFile
+		}
+		return nil
+	}
+	if err != nil {
+		return ErrOpeningFile
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		return ErrWrongFormat
+	}
+	n, err := strconv.Atoi(lines[0])
+	if err != nil {
+		return ErrWrongFormat
+	}
+	if n != shards {
+		return ErrShardCount
+	}
+	if lines[1] != hashName {
+		return ErrShardHash
+	}
+	return nil
+}
+
+func fnvHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (db *ShardedDB) shard(key string) *FileDB {
+	return db.shards[db.hash(key)%uint32(len(db.shards))]
+}
+
+// Create implements the create method of DB.
+func (db *ShardedDB) Create(key, val string) error {
+	return db.shard(key).Create(key, val)
+}
+
+// CreateContext is like Create, see FileDB.CreateContext.
+func (db *ShardedDB) CreateContext(ctx context.Context, key, val string) error {
+	return db.shard(key).CreateContext(ctx, key, val)
+}
+
+// Read implements the read method of DB.
+func (db *ShardedDB) Read(key string) (string, error) {
+	return db.shard(key).Read(key)
+}
+
+// ReadContext is like Read, see FileDB.ReadContext.
+func (db *ShardedDB) ReadContext(ctx context.Context, key string) (string, error) {
+	return db.shard(key).ReadContext(ctx, key)
+}
+
+// Update implements the update method of DB.
+func (db *ShardedDB) Update(key, val string) error {
+	return db.shard(key).Update(key, val)
+}
+
+// UpdateContext is like Update, see FileDB.UpdateContext.
+func (db *ShardedDB) UpdateContext(ctx context.Context, key, val string) error {
+	return db.shard(key).UpdateContext(ctx, key, val)
+}
+
+// Delete implements the delete method of DB.
+func (db *ShardedDB) Delete(key string) (string, error) {
+	return db.shard(key).Delete(key)
+}
+
+// DeleteContext is like Delete, see FileDB.DeleteContext.
+func (db *ShardedDB) DeleteContext(ctx context.Context, key string) (string, error) {
+	return db.shard(key).DeleteContext(ctx, key)
+}
+
+// Keys returns the keys of all the shards, in no particular order.
+func (db *ShardedDB) Keys() ([]string, error) {
+	var keys []string
+	for _, s := range db.shards {
+		k, err := s.Keys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
+
+// ForEach calls fn for every key-value pair of all the shards,
+// in no particular order. See FileDB.ForEach.
+func (db *ShardedDB) ForEach(fn func(key, val string) error) error {
+	for _, s := range db.shards {
+		if err := s.ForEach(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the runtime statistics of all the shards added up.
+func (db *ShardedDB) Stats() Stats {
+	var st Stats
+	for _, s := range db.shards {
+		st.InFlight += s.Stats().InFlight
+	}
+	return st
+}
+
+// Close dumps the data of every shard into its file.
+// It returns the first error found.
+func (db *ShardedDB) Close() error {
+	var first error
+	for _, s := range db.shards {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
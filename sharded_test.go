@@ -0,0 +1,101 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestShardedDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := db.Create("key"+strconv.Itoa(i), "value"); err != nil {
+			t.Fatalf("db.Create() error = %v", err)
+		}
+	}
+	if keys, err := db.Keys(); err != nil || len(keys) != 20 {
+		t.Errorf("db.Keys() = %d keys, %v, want 20", len(keys), err)
+	}
+	n := 0
+	db.ForEach(func(key, val string) error {
+		n++
+		return nil
+	})
+	if n != 20 {
+		t.Errorf("db.ForEach() visited %d keys, want 20", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	if _, err := NewShardedDB(dir, 3); err != ErrShardCount {
+		t.Errorf("NewShardedDB() with other shard count error = %v, want %v", err, ErrShardCount)
+	}
+	db, err = NewShardedDB(dir, 4)
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if v, err := db.Read("key7"); err != nil || v != "value" {
+		t.Errorf("db.Read() = %q, %v, want %q", v, err, "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+}
+
+func TestShardedDBHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewShardedDB(dir, 3, WithHash("one", func(string) uint32 { return 1 }))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Create(k, "value"); err != nil {
+			t.Fatalf("db.Create() error = %v", err)
+		}
+	}
+	if len(db.shards[1].data) != 3 {
+		t.Errorf("expected all keys in shard 1, got %d", len(db.shards[1].data))
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	if _, err := NewShardedDB(dir, 3); err != ErrShardHash {
+		t.Errorf("NewShardedDB() with other hash error = %v, want %v", err, ErrShardHash)
+	}
+}
+
+func TestShardedDBOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewShardedDB(dir, 2, WithHash("nil", nil)); err != ErrWrongFormat {
+		t.Errorf("NewShardedDB() with nil hash error = %v, want %v", err, ErrWrongFormat)
+	}
+	s := newMemStore(map[string]string{})
+	if _, err := NewShardedDB(dir, 2, WithShardOptions(WithRemote(s))); err != ErrShardOption {
+		t.Errorf("NewShardedDB() with WithRemote error = %v, want %v", err, ErrShardOption)
+	}
+	if _, err := NewShardedDB(dir, 2, WithShardOptions(WithUniqueValues())); err != ErrShardOption {
+		t.Errorf("NewShardedDB() with WithUniqueValues error = %v, want %v", err, ErrShardOption)
+	}
+}
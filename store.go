@@ -0,0 +1,161 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// ErrRemoteStore happens when the remote store fails.
+var ErrRemoteStore = errors.New("failed to sync with remote store")
+
+const versionFileSuffix = ".version"
+
+// Store is a remote key-value backend that a FileDB can cache
+// in its local file, see WithRemote.
+type Store interface {
+	// Version returns an opaque identifier of the current state
+	// of the store, e.g. an etag. It must change on every write
+	// and be empty if the store was never written.
+	Version() (string, error)
+	// Load returns all the data in the store and its version.
+	Load() (map[string]string, string, error)
+	// Put sets key to value and returns the new version.
+	Put(key, value string) (string, error)
+	// Remove deletes key and returns the new version.
+	Remove(key string) (string, error)
+}
+
+// WithRemote makes the FileDB a write-through cache of s.
+//
+// On open the local file is loaded and its version, kept next to it
+// in a ".version" file, is compared with s.Version(). If they differ
+// the whole data set is re-fetched from s.
+//
+// The consistency model is:
+//   - s is the source of truth. Writes go to s first and only
+//     change the local data if s accepted them, so a failed write
+//     leaves both untouched and returns ErrRemoteStore.
+//   - Reads are served from the local data only. Changes made to s
+//     by other writers are not seen until the next open.
+//   - The local file is only written on Close. If the process dies
+//     before that, the stale version is detected on the next open
+//     and the data is re-fetched. A local file that can't be parsed
+//     is re-fetched as well.
+//   - If a write finds that s was changed by another writer since
+//     it was loaded, the cache is marked stale and re-fetched on
+//     the next open. A change landing between that check and the
+//     write itself can go unnoticed. Concurrent writes of the same
+//     FileDB can mark it stale too, which only costs a re-fetch.
+//   - Data loaded from s must follow the file format, otherwise
+//     opening fails with ErrWrongFormat.
+func WithRemote(s Store) Option {
+	return func(db *FileDB) {
+		db.remote = s
+	}
+}
+
+// sync loads the data from the remote store if the local
+// cache is stale or `stale` is set.
+func (db *FileDB) sync(filename string, stale bool) error {
+	db.versionFile = filename + versionFileSuffix
+	b, err := ioutil.ReadFile(db.versionFile)
+	if err != nil && !os.IsNotExist(err) {
+		return ErrOpeningFile
+	}
+	local := strings.TrimSpace(string(b))
+	v, err := db.remote.Version()
+	if err != nil {
+		return ErrRemoteStore
+	}
+	if !stale && local != "" && local == v {
+		db.version = v
+		return nil
+	}
+	data, v, err := db.remote.Load()
+	if err != nil {
+		return ErrRemoteStore
+	}
+	if data == nil {
+		data = make(map[string]string)
+	}
+	if err := checkData(data); err != nil {
+		return err
+	}
+	db.data = data
+	db.version = v
+	return nil
+}
+
+// checkData returns ErrWrongFormat if data can't be
+// saved to the file.
+func checkData(data map[string]string) error {
+	for k, v := range data {
+		if !keyFormat.MatchString(k) || strings.Contains(v, "\n") {
+			return ErrWrongFormat
+		}
+	}
+	return nil
+}
+
+// saveVersion persists the version of the remote store
+// the local file holds.
+func (db *FileDB) saveVersion() error {
+	if db.remote == nil {
+		return nil
+	}
+	v := db.version
+	// An empty version makes the next open re-fetch the data.
+	if db.stale {
+		v = ""
+	}
+	if err := ioutil.WriteFile(db.versionFile, []byte(v+"\n"), 0644); err != nil {
+		return ErrSavingToFile
+	}
+	return nil
+}
+
+// put writes key to the remote store, if any.
+// See remoteWrite.
+func (db *FileDB) put(key, val string) error {
+	if db.remote == nil {
+		return nil
+	}
+	return db.remoteWrite(func() (string, error) {
+		return db.remote.Put(key, val)
+	})
+}
+
+// remove deletes key from the remote store, if any.
+// See remoteWrite.
+func (db *FileDB) remove(key string) error {
+	if db.remote == nil {
+		return nil
+	}
+	return db.remoteWrite(func() (string, error) {
+		return db.remote.Remove(key)
+	})
+}
+
+// remoteWrite runs write on the remote store, marking the cache as
+// stale if the store changed since the last version seen. It must be
+// called with db.mu held and the written key reserved, db.mu is
+// released while waiting on the store.
+func (db *FileDB) remoteWrite(write func() (string, error)) error {
+	db.mu.Unlock()
+	cur, err := db.remote.Version()
+	var v string
+	if err == nil {
+		v, err = write()
+	}
+	db.mu.Lock()
+	if err != nil {
+		return ErrRemoteStore
+	}
+	if cur != db.version {
+		db.stale = true
+	}
+	db.version = v
+	return nil
+}
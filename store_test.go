@@ -0,0 +1,231 @@
+package db
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// memStore is an in-memory Store counting the loads.
+type memStore struct {
+	mu      sync.Mutex
+	data    map[string]string
+	version int
+	loads   int
+	fail    bool
+}
+
+func newMemStore(data map[string]string) *memStore {
+	return &memStore{data: data, version: 1}
+}
+
+func (s *memStore) Version() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versionString(), nil
+}
+
+func (s *memStore) versionString() string {
+	if s.version == 0 {
+		return ""
+	}
+	return strconv.Itoa(s.version)
+}
+
+func (s *memStore) Load() (map[string]string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads++
+	d := make(map[string]string, len(s.data))
+	for k, v := range s.data {
+		d[k] = v
+	}
+	return d, s.versionString(), nil
+}
+
+func (s *memStore) Put(key, value string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return "", errors.New("store is down")
+	}
+	s.data[key] = value
+	s.version++
+	return strconv.Itoa(s.version), nil
+}
+
+func (s *memStore) Remove(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return "", errors.New("store is down")
+	}
+	delete(s.data, key)
+	s.version++
+	return strconv.Itoa(s.version), nil
+}
+
+func TestRemoteCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "cache.data")
+	s := newMemStore(map[string]string{"key1": "value1"})
+
+	db, err := NewFileDB(filename, WithRemote(s))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if s.loads != 1 {
+		t.Errorf("expected empty cache to load from store, got %d loads", s.loads)
+	}
+	if v, err := db.Read("key1"); err != nil || v != "value1" {
+		t.Errorf("db.Read() = %q, %v, want %q", v, err, "value1")
+	}
+	if err := db.Create("key2", "value2"); err != nil {
+		t.Fatalf("db.Create() error = %v", err)
+	}
+	if s.data["key2"] != "value2" {
+		t.Errorf("expected Create() to write through to the store")
+	}
+	s.fail = true
+	if err := db.Update("key2", "nope"); err != ErrRemoteStore {
+		t.Errorf("db.Update() error = %v, want %v", err, ErrRemoteStore)
+	}
+	if v, _ := db.Read("key2"); v != "value2" {
+		t.Errorf("expected failed Update() to leave local data untouched, got %q", v)
+	}
+	s.fail = false
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	// Cache is fresh, it must not be re-fetched.
+	db, err = NewFileDB(filename, WithRemote(s))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if s.loads != 1 {
+		t.Errorf("expected fresh cache not to load from store, got %d loads", s.loads)
+	}
+	if v, err := db.Read("key2"); err != nil || v != "value2" {
+		t.Errorf("db.Read() = %q, %v, want %q", v, err, "value2")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	// Another writer changed the store, the cache is stale.
+	s.Put("key3", "value3")
+	db, err = NewFileDB(filename, WithRemote(s))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if s.loads != 2 {
+		t.Errorf("expected stale cache to load from store, got %d loads", s.loads)
+	}
+	if v, err := db.Read("key3"); err != nil || v != "value3" {
+		t.Errorf("db.Read() = %q, %v, want %q", v, err, "value3")
+	}
+
+	// Another writer changed the store before our write.
+	s.Put("other", "value")
+	if err := db.Create("mine", "value"); err != nil {
+		t.Fatalf("db.Create() error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+	db, err = NewFileDB(filename, WithRemote(s))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if s.loads != 3 {
+		t.Errorf("expected cache written after another writer to load from store, got %d loads", s.loads)
+	}
+	if v, err := db.Read("other"); err != nil || v != "value" {
+		t.Errorf("db.Read() = %q, %v, want %q", v, err, "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+
+	// The cache file is gone but its version file is left.
+	if err := os.Remove(filename); err != nil {
+		t.Fatalf("err removing cache: %s", err)
+	}
+	db, err = NewFileDB(filename, WithRemote(s))
+	if err != nil {
+		t.Fatalf("failed to open DB: %s", err)
+	}
+	if s.loads != 4 {
+		t.Errorf("expected missing cache to load from store, got %d loads", s.loads)
+	}
+	if v, err := db.Read("mine"); err != nil || v != "value" {
+		t.Errorf("db.Read() = %q, %v, want %q", v, err, "value")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close DB: %s", err)
+	}
+}
+
+// loadStore is a Store whose Load returns `data`.
+type loadStore struct {
+	*memStore
+	data map[string]string
+}
+
+func (s *loadStore) Load() (map[string]string, string, error) {
+	return s.data, "1", nil
+}
+
+func TestRemoteCacheLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "db")
+	if err != nil {
+		t.Fatalf("err creating dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name    string
+		cache   string
+		data    map[string]string
+		wantErr bool
+	}{
+		{name: "corrupt cache is re-fetched", cache: "sdfa$sdf$:value\n", data: map[string]string{"key": "value"}},
+		{name: "nil data", data: nil},
+		{name: "invalid remote key", data: map[string]string{"k:ey": "value"}, wantErr: true},
+		{name: "invalid remote value", data: map[string]string{"key": "val\nue"}, wantErr: true},
+	}
+	for i, c := range cases {
+		filename := filepath.Join(dir, strconv.Itoa(i)+".data")
+		if err := ioutil.WriteFile(filename, []byte(c.cache), 0644); err != nil {
+			t.Fatalf("err writing cache: %s", err)
+		}
+		s := &loadStore{memStore: newMemStore(map[string]string{}), data: c.data}
+		t.Run(c.name, func(t *testing.T) {
+			db, err := NewFileDB(filename, WithRemote(s))
+			if (err != nil) != c.wantErr {
+				t.Fatalf("NewFileDB() error = %v, wantErr %v", err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(db.data) != len(c.data) {
+				t.Errorf("expected %d keys, got %d", len(c.data), len(db.data))
+			}
+			if err := db.Create("other", "value"); err != nil {
+				t.Errorf("db.Create() error = %v", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Errorf("failed to close DB: %s", err)
+			}
+		})
+	}
+}